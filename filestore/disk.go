@@ -0,0 +1,151 @@
+package filestore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DiskStore is a Backend that persists files under a root directory, so the
+// server can survive restarts and serve files larger than available memory.
+type DiskStore struct {
+	root string
+}
+
+func NewDiskStore(root string) (*DiskStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &DiskStore{root: root}, nil
+}
+
+func (self *DiskStore) path(filename string) string {
+	return filepath.Join(self.root, filename)
+}
+
+func (self *DiskStore) Exists(filename string) bool {
+	_, err := os.Stat(self.path(filename))
+	return err == nil
+}
+
+func (self *DiskStore) Create(filename string, data []byte) bool {
+	file, err := os.OpenFile(self.path(filename), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	_, err = file.WriteAt(data, 0)
+	return err == nil
+}
+
+func (self *DiskStore) Get(filename string) ([]byte, bool) {
+	file, err := os.Open(self.path(filename))
+
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, false
+	}
+
+	data := make([]byte, info.Size())
+	_, err = file.ReadAt(data, 0)
+
+	if err != nil && err != io.EOF {
+		return nil, false
+	}
+
+	return data, true
+}
+
+func (self *DiskStore) OpenRead(filename string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(self.path(filename))
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+func (self *DiskStore) OpenWrite(filename string) (io.WriteCloser, error) {
+	if self.Exists(filename) {
+		return nil, os.ErrExist
+	}
+
+	temp, err := os.CreateTemp(self.root, filename+".part-*")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &diskWriter{store: self, filename: filename, temp: temp}, nil
+}
+
+// diskWriter buffers a new file under a temp name in the store's root, so
+// - like MemoryStore's writer - nothing is visible via Exists()/OpenRead()
+// until Close succeeds.
+type diskWriter struct {
+	store    *DiskStore
+	filename string
+	temp     *os.File
+}
+
+func (self *diskWriter) Write(data []byte) (int, error) {
+	return self.temp.Write(data)
+}
+
+func (self *diskWriter) Close() error {
+	if err := self.temp.Close(); err != nil {
+		os.Remove(self.temp.Name())
+		return err
+	}
+
+	if self.store.Exists(self.filename) {
+		os.Remove(self.temp.Name())
+		return os.ErrExist
+	}
+
+	return os.Rename(self.temp.Name(), self.store.path(self.filename))
+}
+
+// Abort discards the in-progress write instead of finishing it, for a
+// transfer that gives up partway through.
+func (self *diskWriter) Abort() {
+	self.temp.Close()
+	os.Remove(self.temp.Name())
+}
+
+func (self *DiskStore) Replace(filename string, data []byte) bool {
+	temp, err := os.CreateTemp(self.root, filename+".resume-*")
+
+	if err != nil {
+		return false
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return false
+	}
+
+	if err := temp.Close(); err != nil {
+		return false
+	}
+
+	return os.Rename(temp.Name(), self.path(filename)) == nil
+}
@@ -0,0 +1,194 @@
+package filestore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func Test_DiskStore_CreateAndGet(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+
+	name := "a_file"
+	file := fakeFile(4096)
+
+	if !store.Create(name, file) {
+		t.Fatal("Failed to create new file")
+	}
+
+	if store.Create(name, file) {
+		t.Error("Expected second create of the same file to fail")
+	}
+
+	retrievedFile, found := store.Get(name)
+
+	if !found {
+		t.Errorf("Get() failed to find file %s", name)
+	}
+
+	if fmt.Sprintf("%v", retrievedFile) != fmt.Sprintf("%v", file) {
+		t.Error("Written file contents did not match what was read back")
+	}
+}
+
+func Test_DiskStore_Exists(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+
+	name := "some_file"
+
+	if store.Exists(name) {
+		t.Errorf("%s should not exist yet", name)
+	}
+
+	store.Create(name, fakeFile(64))
+
+	if !store.Exists(name) {
+		t.Errorf("%s should exist now", name)
+	}
+}
+
+func Test_DiskStore_OpenReadAndOpenWrite(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+
+	name := "a_file"
+	file := fakeFile(8192)
+
+	writer, err := store.OpenWrite(name)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s for writing: %v", name, err)
+	}
+
+	writer.Write(file[:4096])
+	writer.Write(file[4096:])
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer for %s: %v", name, err)
+	}
+
+	reader, size, err := store.OpenRead(name)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s for reading: %v", name, err)
+	}
+	defer reader.Close()
+
+	if size != int64(len(file)) {
+		t.Errorf("Expected reported size %v, got %v", len(file), size)
+	}
+
+	data, err := io.ReadAll(reader)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+
+	if fmt.Sprintf("%v", data) != fmt.Sprintf("%v", file) {
+		t.Error("Read file contents did not match what was written")
+	}
+}
+
+func Test_DiskStore_OpenWrite_notVisibleUntilClosed(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+
+	name := "a_file"
+
+	writer, err := store.OpenWrite(name)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s for writing: %v", name, err)
+	}
+
+	writer.Write(fakeFile(64))
+
+	if store.Exists(name) {
+		t.Error("File should not be visible until the writer is closed")
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer for %s: %v", name, err)
+	}
+
+	if !store.Exists(name) {
+		t.Error("File should exist after the writer is closed")
+	}
+}
+
+func Test_DiskStore_OpenWrite_abortLeavesNoFile(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewDiskStore(root)
+
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+
+	name := "a_file"
+
+	writer, err := store.OpenWrite(name)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s for writing: %v", name, err)
+	}
+
+	writer.Write(fakeFile(64))
+	writer.(*diskWriter).Abort()
+
+	if store.Exists(name) {
+		t.Error("An aborted write should not make the file visible")
+	}
+
+	entries, err := os.ReadDir(root)
+
+	if err != nil {
+		t.Fatalf("Failed to read store root: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("Aborting should not leave any stray files behind, found %v", entries)
+	}
+}
+
+func Test_DiskStore_Replace(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+
+	if err != nil {
+		t.Fatalf("Failed to create disk store: %v", err)
+	}
+
+	name := "a_file"
+	original := fakeFile(100)
+	replacement := fakeFile(200)
+
+	store.Create(name, original)
+
+	if !store.Replace(name, replacement) {
+		t.Fatal("Failed to replace existing file")
+	}
+
+	retrievedFile, found := store.Get(name)
+
+	if !found {
+		t.Errorf("%s should still exist after being replaced", name)
+	}
+
+	if fmt.Sprintf("%v", retrievedFile) != fmt.Sprintf("%v", replacement) {
+		t.Error("Replaced file contents did not match the replacement")
+	}
+}
@@ -1,39 +1,71 @@
 package filestore
 
-import "sync"
+import (
+	"crypto/sha256"
+	"io"
+)
 
-var files map[string][]byte
-var mutex sync.RWMutex
+// Backend stores and retrieves files for the server. Exists/Create/Get
+// operate on whole files in one call; OpenRead/OpenWrite stream one block
+// at a time so the server never has to hold an entire file in memory.
+type Backend interface {
+	Exists(filename string) bool
+	Create(filename string, data []byte) bool
+	Get(filename string) ([]byte, bool)
+	OpenRead(filename string) (io.ReadCloser, int64, error)
+	OpenWrite(filename string) (io.WriteCloser, error)
 
-func Init() {
-	files = map[string][]byte{}
+	// Replace atomically overwrites filename with data, unlike Create,
+	// which refuses to touch a file that already exists. It is used to
+	// write back a file reconstructed via a block-level resume.
+	Replace(filename string, data []byte) bool
 }
 
-func Exists(filename string) bool {
-	mutex.RLock()
-	defer mutex.RUnlock()
-
-	_, found := files[filename]
-	return found
+// Block describes one fixed-size chunk of a file, identified by its
+// position and content hash, as used by the block-level resume/delta
+// transfer extension.
+type Block struct {
+	Offset int64
+	Size   int32
+	Sha256 [32]byte
 }
 
-func Create(filename string, data []byte) bool {
-	if Exists(filename) {
-		return false
+// Blocks splits filename into fixed-size blocks (the last one may be
+// shorter) and hashes each with SHA-256, streaming the file through a
+// single blockSize buffer so memory use stays bounded regardless of file
+// size.
+func Blocks(backend Backend, filename string, blockSize int) ([]Block, error) {
+	reader, _, err := backend.OpenRead(filename)
+
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	blocks := []Block{}
+	buffer := make([]byte, blockSize)
+	offset := int64(0)
 
-	files[filename] = data
-	return true
-}
+	for {
+		n, err := io.ReadFull(reader, buffer)
 
-func Get(filename string) ([]byte, bool) {
-	mutex.RLock()
-	defer mutex.RUnlock()
+		if n > 0 {
+			blocks = append(blocks, Block{
+				Offset: offset,
+				Size:   int32(n),
+				Sha256: sha256.Sum256(buffer[:n]),
+			})
+			offset += int64(n)
+		}
 
-	file, found := files[filename]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return file, found
+	return blocks, nil
 }
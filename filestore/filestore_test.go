@@ -1,76 +1,56 @@
 package filestore
 
 import (
-	"fmt"
+	"crypto/sha256"
 	"testing"
 )
 
-func fakeFile(size int) []byte {
-	file := make([]byte, size)
+func Test_Blocks(t *testing.T) {
+	store := NewMemoryStore()
 
-	for i := 0; i < size; i++ {
-		file[i] = byte(i % 16)
-	}
-
-	return file
-}
-
-func Test_Init(t *testing.T) {
-	Init()
-
-	if files == nil {
-		t.Error("Init did not initialize the files map")
-	}
-}
-
-func Test_Create(t *testing.T) {
-	Init()
+	file := fakeFile(1000)
+	store.Create("a_file", file)
 
-	data := fakeFile(1024)
-	success := Create("filename", data)
+	blocks, err := Blocks(store, "a_file", 400)
 
-	if success == false {
-		t.Error("Failed to create new file")
+	if err != nil {
+		t.Fatalf("Failed to compute blocks: %v", err)
 	}
-}
-
-func Test_Exists(t *testing.T) {
-	Init()
 
-	name := "some_file"
-
-	if Exists(name) {
-		t.Error(fmt.Sprintf("%s should not exist yet"))
+	if len(blocks) != 3 {
+		t.Fatalf("Expected 3 blocks for a 1000 byte file split into 400 byte chunks, got %v", len(blocks))
 	}
 
-	Create(name, fakeFile(1234))
-
-	if !Exists(name) {
-		t.Error(fmt.Sprintf("%s should exist now"))
+	expected := []struct {
+		offset int64
+		size   int32
+	}{
+		{0, 400},
+		{400, 400},
+		{800, 200},
 	}
-}
 
-func Test_Get(t *testing.T) {
-	Init()
-
-	name := "a_file"
+	for i, want := range expected {
+		if blocks[i].Offset != want.offset {
+			t.Errorf("Block %v: expected offset %v, got %v", i, want.offset, blocks[i].Offset)
+		}
 
-	file := fakeFile(9999)
+		if blocks[i].Size != want.size {
+			t.Errorf("Block %v: expected size %v, got %v", i, want.size, blocks[i].Size)
+		}
 
-	Create(name, file)
-	retrievedFile, found := Get(name)
+		expectedSum := sha256.Sum256(file[blocks[i].Offset : blocks[i].Offset+int64(blocks[i].Size)])
 
-	if found == false {
-		t.Error(fmt.Sprintf("Get() failed to find file %s", name))
+		if blocks[i].Sha256 != expectedSum {
+			t.Errorf("Block %v: hash did not match the corresponding slice of the file", i)
+		}
 	}
+}
 
-	if len(file) != len(retrievedFile) {
-		t.Error(fmt.Sprintf("Files were not the same length, %v vs %v", len(file), len(retrievedFile)))
-	}
+func Test_Blocks_missingFile(t *testing.T) {
+	store := NewMemoryStore()
 
-	for i, val := range file {
-		if val != retrievedFile[i] {
-			t.Error(fmt.Sprintf("Files were not the same. Byte %v differs, %v vs %v", i, val, retrievedFile[i]))
-		}
+	if _, err := Blocks(store, "missing", 400); err == nil {
+		t.Error("Expected an error computing blocks for a missing file")
 	}
 }
@@ -0,0 +1,106 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// MemoryStore is an in-memory Backend. It never persists across restarts and
+// holds every file fully in RAM, but is simple and fast for small transfers
+// and tests.
+type MemoryStore struct {
+	mutex sync.RWMutex
+	files map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{files: map[string][]byte{}}
+}
+
+func (self *MemoryStore) Exists(filename string) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	_, found := self.files[filename]
+	return found
+}
+
+func (self *MemoryStore) Create(filename string, data []byte) bool {
+	if self.Exists(filename) {
+		return false
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.files[filename] = data
+	return true
+}
+
+func (self *MemoryStore) Get(filename string) ([]byte, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	file, found := self.files[filename]
+
+	return file, found
+}
+
+func (self *MemoryStore) Replace(filename string, data []byte) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.files[filename] = data
+	return true
+}
+
+// memoryReader embeds *bytes.Reader directly (rather than via the io.Reader
+// interface) so that callers can type-assert it to io.ReaderAt for the
+// random-access reads the block-level resume extension needs.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func (self *MemoryStore) OpenRead(filename string) (io.ReadCloser, int64, error) {
+	file, found := self.Get(filename)
+
+	if !found {
+		return nil, 0, os.ErrNotExist
+	}
+
+	return memoryReader{bytes.NewReader(file)}, int64(len(file)), nil
+}
+
+func (self *MemoryStore) OpenWrite(filename string) (io.WriteCloser, error) {
+	if self.Exists(filename) {
+		return nil, os.ErrExist
+	}
+
+	return &memoryWriter{store: self, filename: filename}, nil
+}
+
+// memoryWriter buffers a file in memory and hands it to the store on Close,
+// so a write that never finishes never becomes visible to readers.
+type memoryWriter struct {
+	store    *MemoryStore
+	filename string
+	buffer   bytes.Buffer
+}
+
+func (self *memoryWriter) Write(data []byte) (int, error) {
+	return self.buffer.Write(data)
+}
+
+func (self *memoryWriter) Close() error {
+	if !self.store.Create(self.filename, self.buffer.Bytes()) {
+		return os.ErrExist
+	}
+
+	return nil
+}
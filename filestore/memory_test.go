@@ -0,0 +1,171 @@
+package filestore
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func fakeFile(size int) []byte {
+	file := make([]byte, size)
+
+	for i := 0; i < size; i++ {
+		file[i] = byte(i % 16)
+	}
+
+	return file
+}
+
+func Test_MemoryStore_Create(t *testing.T) {
+	store := NewMemoryStore()
+
+	data := fakeFile(1024)
+	success := store.Create("filename", data)
+
+	if success == false {
+		t.Error("Failed to create new file")
+	}
+
+	if store.Create("filename", data) {
+		t.Error("Expected second create of the same file to fail")
+	}
+}
+
+func Test_MemoryStore_Exists(t *testing.T) {
+	store := NewMemoryStore()
+
+	name := "some_file"
+
+	if store.Exists(name) {
+		t.Errorf("%s should not exist yet", name)
+	}
+
+	store.Create(name, fakeFile(1234))
+
+	if !store.Exists(name) {
+		t.Errorf("%s should exist now", name)
+	}
+}
+
+func Test_MemoryStore_Get(t *testing.T) {
+	store := NewMemoryStore()
+
+	name := "a_file"
+	file := fakeFile(9999)
+
+	store.Create(name, file)
+	retrievedFile, found := store.Get(name)
+
+	if found == false {
+		t.Errorf("Get() failed to find file %s", name)
+	}
+
+	if len(file) != len(retrievedFile) {
+		t.Errorf("Files were not the same length, %v vs %v", len(file), len(retrievedFile))
+	}
+
+	for i, val := range file {
+		if val != retrievedFile[i] {
+			t.Errorf("Files were not the same. Byte %v differs, %v vs %v", i, val, retrievedFile[i])
+		}
+	}
+}
+
+func Test_MemoryStore_OpenRead(t *testing.T) {
+	store := NewMemoryStore()
+
+	name := "a_file"
+	file := fakeFile(2000)
+	store.Create(name, file)
+
+	reader, size, err := store.OpenRead(name)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s for reading: %v", name, err)
+	}
+	defer reader.Close()
+
+	if size != int64(len(file)) {
+		t.Errorf("Expected reported size %v, got %v", len(file), size)
+	}
+
+	data, err := io.ReadAll(reader)
+
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", name, err)
+	}
+
+	if len(data) != len(file) {
+		t.Errorf("Read %v bytes, expected %v", len(data), len(file))
+	}
+}
+
+func Test_MemoryStore_OpenRead_missing(t *testing.T) {
+	store := NewMemoryStore()
+
+	if _, _, err := store.OpenRead("missing"); err == nil {
+		t.Error("Expected an error opening a missing file for reading")
+	}
+}
+
+func Test_MemoryStore_OpenWrite(t *testing.T) {
+	store := NewMemoryStore()
+
+	name := "a_file"
+	file := fakeFile(1500)
+
+	writer, err := store.OpenWrite(name)
+
+	if err != nil {
+		t.Fatalf("Failed to open %s for writing: %v", name, err)
+	}
+
+	writer.Write(file[:500])
+	writer.Write(file[500:])
+
+	if store.Exists(name) {
+		t.Error("File should not be visible until the writer is closed")
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer for %s: %v", name, err)
+	}
+
+	retrievedFile, found := store.Get(name)
+
+	if !found {
+		t.Errorf("%s should exist after the writer is closed", name)
+	}
+
+	if fmt.Sprintf("%v", retrievedFile) != fmt.Sprintf("%v", file) {
+		t.Error("Written file contents did not match what was read back")
+	}
+
+	if _, err := store.OpenWrite(name); err == nil {
+		t.Error("Expected opening an existing file for writing to fail")
+	}
+}
+
+func Test_MemoryStore_Replace(t *testing.T) {
+	store := NewMemoryStore()
+
+	name := "a_file"
+	original := fakeFile(100)
+	replacement := fakeFile(200)
+
+	store.Create(name, original)
+
+	if !store.Replace(name, replacement) {
+		t.Fatal("Failed to replace existing file")
+	}
+
+	retrievedFile, found := store.Get(name)
+
+	if !found {
+		t.Errorf("%s should still exist after being replaced", name)
+	}
+
+	if fmt.Sprintf("%v", retrievedFile) != fmt.Sprintf("%v", replacement) {
+		t.Error("Replaced file contents did not match the replacement")
+	}
+}
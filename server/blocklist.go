@@ -0,0 +1,365 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"tftp/filestore"
+)
+
+const blockListEntrySize = 8 + 4 + 32 // offset + size + sha256
+
+// blockListPacket encodes a block list (used for both BlockListRequest and
+// BlockListReply, which share the same body format) as a sequence of fixed
+// size offset/size/sha256 entries.
+func blockListPacket(op OpCode, blocks []filestore.Block) []byte {
+	packet := make([]byte, 2, 2+len(blocks)*blockListEntrySize)
+	binary.BigEndian.PutUint16(packet, uint16(op))
+
+	for _, block := range blocks {
+		entry := make([]byte, blockListEntrySize)
+		binary.BigEndian.PutUint64(entry[0:8], uint64(block.Offset))
+		binary.BigEndian.PutUint32(entry[8:12], uint32(block.Size))
+		copy(entry[12:], block.Sha256[:])
+
+		packet = append(packet, entry...)
+	}
+
+	return packet
+}
+
+func parseBlockList(packet []byte) ([]filestore.Block, bool) {
+	body := packet[2:]
+
+	if len(body)%blockListEntrySize != 0 {
+		return nil, false
+	}
+
+	blocks := make([]filestore.Block, 0, len(body)/blockListEntrySize)
+
+	for i := 0; i < len(body); i += blockListEntrySize {
+		entry := body[i : i+blockListEntrySize]
+
+		var sum [32]byte
+		copy(sum[:], entry[12:])
+
+		blocks = append(blocks, filestore.Block{
+			Offset: int64(binary.BigEndian.Uint64(entry[0:8])),
+			Size:   int32(binary.BigEndian.Uint32(entry[8:12])),
+			Sha256: sum,
+		})
+	}
+
+	return blocks, true
+}
+
+// validBlockList reports whether blocks forms the well-formed sequence
+// filestore.Blocks would have produced for blockSize: contiguous,
+// non-overlapping chunks of exactly blockSize, with only the final one
+// allowed to be shorter. A client block list failing this check is
+// rejected outright, since its offsets/sizes are otherwise used directly
+// to size and index the reconstruction buffer in
+// handleBlockListResumeWrite.
+func validBlockList(blocks []filestore.Block, blockSize int) bool {
+	for i, block := range blocks {
+		if block.Offset != int64(i)*int64(blockSize) {
+			return false
+		}
+
+		if i < len(blocks)-1 {
+			if block.Size != int32(blockSize) {
+				return false
+			}
+		} else if block.Size < 0 || block.Size > int32(blockSize) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handleBlockListResumeRead implements the read side of the block-level
+// resume extension: it waits for the client's BlockListRequest, replies
+// with its own block list, and then streams back only the specific block
+// indices the client goes on to request. The client addresses blocks by
+// their 1-based index into the server's list and signals it is done by
+// requesting index 0.
+func handleBlockListResumeRead(request requestPacket, conn net.Conn, backend filestore.Backend, opts transferOptions) {
+	buffer := make([]byte, 65536)
+
+	if !waitForBlockListRequest(conn, opts.timeout, buffer) {
+		conn.Write(errorPacket(NotDefinedError, "Failed to get block list request after 5 attempts"))
+		return
+	}
+
+	serverBlocks, err := filestore.Blocks(backend, request.filename, opts.blockListBlockSize)
+
+	if err != nil {
+		conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to hash %s: %v", request.filename, err)))
+		return
+	}
+
+	reply := blockListPacket(BlockListReplyOp, serverBlocks)
+
+	if !sendAndWaitForAck(conn, reply, 0, opts.timeout, buffer) {
+		conn.Write(errorPacket(NotDefinedError, "Failed to get ACK for block list reply after 5 attempts"))
+		return
+	}
+
+	file, _, err := backend.OpenRead(request.filename)
+
+	if err != nil {
+		conn.Write(errorPacket(FileNotFoundError, fmt.Sprintf("File not found: %s", request.filename)))
+		return
+	}
+	defer file.Close()
+
+	readerAt, ok := file.(io.ReaderAt)
+
+	if !ok {
+		conn.Write(errorPacket(NotDefinedError, "Backend does not support the random access reads resume requires"))
+		return
+	}
+
+	for {
+		requestedIndex, ok := waitForBlockRequest(conn, opts.timeout, buffer)
+
+		if !ok {
+			conn.Write(errorPacket(NotDefinedError, "Failed to get next block request after 5 attempts"))
+			return
+		}
+
+		if requestedIndex == 0 || int(requestedIndex) > len(serverBlocks) {
+			fmt.Println(fmt.Sprintf("Resumed transfer of %s complete", request.filename))
+			return
+		}
+
+		block := serverBlocks[requestedIndex-1]
+		data := make([]byte, block.Size)
+
+		if _, err := readerAt.ReadAt(data, block.Offset); err != nil && err != io.EOF {
+			conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to read block %v: %v", requestedIndex, err)))
+			return
+		}
+
+		conn.Write(dataPacket(data, requestedIndex))
+	}
+}
+
+// handleBlockListResumeWrite implements the write side: it hashes whatever
+// copy of the file it already has, compares it against the block list the
+// client sends for the version it wants to upload, and replies with a
+// bitmap of the block indices that differ. The client then sends just
+// those blocks, addressed by index, and the reconstructed file is written
+// back via Backend.Replace.
+func handleBlockListResumeWrite(request requestPacket, conn net.Conn, backend filestore.Backend, opts transferOptions, ack map[string]string, maxFileSize int64) {
+	buffer := make([]byte, 65536)
+	oack := oackPacket(ack)
+
+	attempts := 1
+	var clientBlocks []filestore.Block
+
+	for {
+		if attempts > 5 {
+			conn.Write(errorPacket(NotDefinedError, "Failed to get block list request after 5 attempts"))
+			return
+		}
+
+		conn.Write(oack)
+
+		conn.SetReadDeadline(time.Now().Add(opts.timeout))
+		bytesRead, err := conn.Read(buffer)
+
+		if err == nil && bytesRead >= 2 && getOpCode(buffer[:bytesRead]) == BlockListRequestOp {
+			if blocks, ok := parseBlockList(buffer[:bytesRead]); ok {
+				clientBlocks = blocks
+				break
+			}
+		}
+
+		attempts++
+	}
+
+	if !validBlockList(clientBlocks, opts.blockListBlockSize) {
+		conn.Write(errorPacket(IllegalOperationError, "Malformed block list"))
+		return
+	}
+
+	totalSize := int64(0)
+	if len(clientBlocks) > 0 {
+		last := clientBlocks[len(clientBlocks)-1]
+		totalSize = last.Offset + int64(last.Size)
+	}
+
+	if maxFileSize > 0 && totalSize > maxFileSize {
+		conn.Write(errorPacket(DiskFullError, fmt.Sprintf("Declared file size %v exceeds the server limit of %v bytes", totalSize, maxFileSize)))
+		return
+	}
+
+	var existingBlocks []filestore.Block
+
+	if backend.Exists(request.filename) {
+		blocks, err := filestore.Blocks(backend, request.filename, opts.blockListBlockSize)
+
+		if err != nil {
+			conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to hash existing %s: %v", request.filename, err)))
+			return
+		}
+
+		existingBlocks = blocks
+	}
+
+	needed := make([]byte, (len(clientBlocks)+7)/8)
+
+	for i, block := range clientBlocks {
+		if i >= len(existingBlocks) || existingBlocks[i].Sha256 != block.Sha256 {
+			needed[i/8] |= 1 << uint(i%8)
+		}
+	}
+
+	reply := make([]byte, 2, 2+len(needed))
+	binary.BigEndian.PutUint16(reply, uint16(BlockListReplyOp))
+	reply = append(reply, needed...)
+
+	if !sendAndWaitForAck(conn, reply, 0, opts.timeout, buffer) {
+		conn.Write(errorPacket(NotDefinedError, "Failed to get ACK for needed-blocks bitmap after 5 attempts"))
+		return
+	}
+
+	file := make([]byte, totalSize)
+
+	reader, _, err := backend.OpenRead(request.filename)
+	var readerAt io.ReaderAt
+
+	if err == nil {
+		defer reader.Close()
+		readerAt, _ = reader.(io.ReaderAt)
+	}
+
+	blockNumber := uint16(0)
+	ackToSend := ackPacket(0)
+
+	for i, block := range clientBlocks {
+		isNeeded := needed[i/8]&(1<<uint(i%8)) != 0
+
+		if !isNeeded {
+			if readerAt == nil {
+				conn.Write(errorPacket(NotDefinedError, "Backend does not support the random access reads resume requires"))
+				return
+			}
+
+			if _, err := readerAt.ReadAt(file[block.Offset:block.Offset+int64(block.Size)], existingBlocks[i].Offset); err != nil && err != io.EOF {
+				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to read existing block %v: %v", i+1, err)))
+				return
+			}
+
+			continue
+		}
+
+		attempts := 1
+		var data []byte
+
+		for {
+			if attempts > 5 {
+				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to get block #%v after 5 attempts", i+1)))
+				return
+			}
+
+			conn.Write(ackToSend)
+			conn.SetReadDeadline(time.Now().Add(opts.timeout))
+
+			bytesRead, err := conn.Read(buffer)
+
+			if err == nil {
+				if blockData, block, parseErr := parseData(buffer[:bytesRead]); parseErr == nil && block == uint16(i+1) {
+					data = blockData
+					break
+				}
+			}
+
+			attempts++
+		}
+
+		copy(file[block.Offset:block.Offset+int64(block.Size)], data)
+		blockNumber = uint16(i + 1)
+		ackToSend = ackPacket(blockNumber)
+	}
+
+	if backend.Replace(request.filename, file) {
+		conn.Write(ackPacket(blockNumber))
+		fmt.Println(fmt.Sprintf("Successfully resumed write of file: %s, %v bytes", request.filename, len(file)))
+	} else {
+		conn.Write(errorPacket(DiskFullError, fmt.Sprintf("Failed to write file: %s", request.filename)))
+	}
+}
+
+// sendAndWaitForAck sends packet and waits for an ACK of expectedBlockNumber,
+// resending packet on each timeout, up to 5 attempts in all.
+func sendAndWaitForAck(conn net.Conn, packet []byte, expectedBlockNumber uint16, timeout time.Duration, buffer []byte) bool {
+	attempts := 1
+
+	for {
+		if attempts > 5 {
+			return false
+		}
+
+		conn.Write(packet)
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		bytesRead, err := conn.Read(buffer)
+
+		if err == nil && parseAck(buffer[:bytesRead], expectedBlockNumber) {
+			return true
+		}
+
+		attempts++
+	}
+}
+
+// waitForBlockListRequest waits (without prompting, since the client
+// initiates this exchange) for a BlockListRequestOp packet.
+func waitForBlockListRequest(conn net.Conn, timeout time.Duration, buffer []byte) bool {
+	attempts := 1
+
+	for {
+		if attempts > 5 {
+			return false
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		bytesRead, err := conn.Read(buffer)
+
+		if err == nil && bytesRead >= 2 && getOpCode(buffer[:bytesRead]) == BlockListRequestOp {
+			return true
+		}
+
+		attempts++
+	}
+}
+
+// waitForBlockRequest waits for the client's next "send me this block
+// index" request, which reuses the ACK wire format with the block number
+// field carrying the requested index.
+func waitForBlockRequest(conn net.Conn, timeout time.Duration, buffer []byte) (uint16, bool) {
+	attempts := 1
+
+	for {
+		if attempts > 5 {
+			return 0, false
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		bytesRead, err := conn.Read(buffer)
+
+		if err == nil {
+			if blockNumber, ok := parseAckBlockNumber(buffer[:bytesRead]); ok {
+				return blockNumber, true
+			}
+		}
+
+		attempts++
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/sha256"
+	"testing"
+	"tftp/filestore"
+)
+
+func Test_blockListPacket(t *testing.T) {
+	blocks := []filestore.Block{
+		{Offset: 0, Size: 400, Sha256: sha256.Sum256(fakeData(400))},
+		{Offset: 400, Size: 200, Sha256: sha256.Sum256(fakeData(200))},
+	}
+
+	packet := blockListPacket(BlockListReplyOp, blocks)
+
+	opcode := OpCode(int(packet[0])<<8 | int(packet[1]))
+	if opcode != BlockListReplyOp {
+		t.Errorf("Block list packet created with incorrect opcode: %#v", opcode)
+	}
+
+	parsed, ok := parseBlockList(packet)
+
+	if !ok {
+		t.Fatal("Failed to parse block list packet")
+	}
+
+	if len(parsed) != len(blocks) {
+		t.Fatalf("Expected %v blocks, got %v", len(blocks), len(parsed))
+	}
+
+	for i, block := range blocks {
+		if parsed[i] != block {
+			t.Errorf("Block %v did not round-trip: %#v, expected %#v", i, parsed[i], block)
+		}
+	}
+}
+
+func Test_parseBlockList_malformed(t *testing.T) {
+	if _, ok := parseBlockList([]byte{0, 7, 1, 2, 3}); ok {
+		t.Error("Expected a body whose length isn't a multiple of the entry size to fail to parse")
+	}
+}
+
+func Test_handleBlockListResumeRead(t *testing.T) {
+	var conn fakeConn
+	conn.t = t
+
+	backend := filestore.NewMemoryStore()
+
+	file := fakeData(1000)
+	backend.Create("file1", file)
+
+	serverBlocks, err := filestore.Blocks(backend, "file1", 400)
+
+	if err != nil {
+		t.Fatalf("Failed to compute blocks: %v", err)
+	}
+
+	conn.packets = [][]byte{
+		blockListPacket(BlockListRequestOp, nil),
+		blockListPacket(BlockListReplyOp, serverBlocks),
+		ackPacket(0),
+		ackPacket(1),
+		dataPacket(file[0:400], 1),
+		ackPacket(2),
+		dataPacket(file[400:800], 2),
+		ackPacket(3),
+		dataPacket(file[800:1000], 3),
+		ackPacket(0),
+	}
+
+	opts := transferOptions{blockListBlockSize: 400, timeout: Timeout}
+	handleBlockListResumeRead(requestPacket{filename: "file1"}, &conn, backend, opts)
+
+	if len(conn.packets) != 0 {
+		t.Errorf("Did not complete transaction, %v packets still left", len(conn.packets))
+	}
+}
+
+func Test_handleBlockListResumeWrite(t *testing.T) {
+	var conn fakeConn
+	conn.t = t
+
+	backend := filestore.NewMemoryStore()
+
+	original := fakeData(1000)
+	backend.Create("file1", original)
+
+	newSecondBlock := make([]byte, 500)
+	for i := range newSecondBlock {
+		newSecondBlock[i] = original[500+i] ^ 0xFF // guaranteed to differ from the original block
+	}
+
+	clientBlocks := []filestore.Block{
+		{Offset: 0, Size: 500, Sha256: sha256.Sum256(original[0:500])},
+		{Offset: 500, Size: 500, Sha256: sha256.Sum256(newSecondBlock)},
+	}
+
+	conn.packets = [][]byte{
+		oackPacket(map[string]string{}),
+		blockListPacket(BlockListRequestOp, clientBlocks),
+		append([]byte{0, byte(BlockListReplyOp)}, 0x02), // bit 1 set: only the second block is needed
+		ackPacket(0),
+		ackPacket(0),
+		dataPacket(newSecondBlock, 2),
+		ackPacket(2),
+	}
+
+	opts := transferOptions{blockListBlockSize: 500, timeout: Timeout}
+	handleBlockListResumeWrite(requestPacket{filename: "file1"}, &conn, backend, opts, map[string]string{}, 0)
+
+	if len(conn.packets) != 0 {
+		t.Errorf("Did not complete transaction, %v packets still left", len(conn.packets))
+	}
+
+	retrievedFile, found := backend.Get("file1")
+
+	if !found {
+		t.Fatal("file1 should still exist after the resumed write")
+	}
+
+	expected := append(append([]byte{}, original[0:500]...), newSecondBlock...)
+
+	if string(retrievedFile) != string(expected) {
+		t.Error("Resumed write did not reconstruct the expected file contents")
+	}
+}
+
+// Test_handleBlockListResumeWrite_malformedOffsetIsRejected guards against a
+// crafted block list with an out-of-range offset driving a negative/invalid
+// slice length in the reconstruction buffer, which previously panicked and
+// took down the whole server process.
+func Test_handleBlockListResumeWrite_malformedOffsetIsRejected(t *testing.T) {
+	var conn fakeConn
+	conn.t = t
+
+	backend := filestore.NewMemoryStore()
+	backend.Create("file1", fakeData(1000))
+
+	maliciousBlocks := []filestore.Block{
+		{Offset: -1000, Size: 500},
+	}
+
+	conn.packets = [][]byte{
+		oackPacket(map[string]string{}),
+		blockListPacket(BlockListRequestOp, maliciousBlocks),
+		errorPacket(IllegalOperationError, "Malformed block list"),
+	}
+
+	opts := transferOptions{blockListBlockSize: 500, timeout: Timeout}
+	handleBlockListResumeWrite(requestPacket{filename: "file1"}, &conn, backend, opts, map[string]string{}, 0)
+
+	if len(conn.packets) != 0 {
+		t.Errorf("Did not complete transaction, %v packets still left", len(conn.packets))
+	}
+}
+
+// Test_handleBlockListResumeWrite_exceedsMaxFileSize guards against a client
+// declaring a well-formed but huge block list to force the server to
+// allocate a reconstruction buffer well beyond the configured file size
+// limit, before a single byte of real data has been transferred.
+func Test_handleBlockListResumeWrite_exceedsMaxFileSize(t *testing.T) {
+	var conn fakeConn
+	conn.t = t
+
+	backend := filestore.NewMemoryStore()
+
+	hugeBlocks := []filestore.Block{
+		{Offset: 0, Size: 500},
+		{Offset: 500, Size: 500},
+		{Offset: 1000, Size: 500},
+	}
+
+	conn.packets = [][]byte{
+		oackPacket(map[string]string{}),
+		blockListPacket(BlockListRequestOp, hugeBlocks),
+		errorPacket(DiskFullError, "Declared file size 1500 exceeds the server limit of 1000 bytes"),
+	}
+
+	opts := transferOptions{blockListBlockSize: 500, timeout: Timeout}
+	handleBlockListResumeWrite(requestPacket{filename: "file1"}, &conn, backend, opts, map[string]string{}, 1000)
+
+	if len(conn.packets) != 0 {
+		t.Errorf("Did not complete transaction, %v packets still left", len(conn.packets))
+	}
+
+	if backend.Exists("file1") {
+		t.Error("File should not have been created when the declared size exceeds the limit")
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"tftp/filestore"
+)
+
+// transfer records the address a client is using for a transfer already in
+// progress, keyed in Listener.transfers by that same address so a
+// retransmitted initial request doesn't spawn a second, redundant transfer.
+type transfer struct {
+	remoteAddr *net.UDPAddr
+	localPort  int
+}
+
+// Listener owns the well-known TFTP port and demultiplexes inbound
+// datagrams: a request from a new client address gets its own ephemeral
+// *net.UDPConn to use as the server's half of the transfer ID, while one
+// from a client already being served is dropped, since that transfer owns
+// retrying on its own.
+type Listener struct {
+	conn        *net.UDPConn
+	backend     filestore.Backend
+	congestion  congestionParams
+	maxFileSize int64
+
+	mutex     sync.Mutex
+	transfers map[string]*transfer
+}
+
+// NewListener binds the well-known TFTP port and prepares a Listener to
+// serve requests with the given Config.
+func NewListener(config Config) (*Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", ":69")
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	backend := config.Backend
+
+	if backend == nil {
+		backend = filestore.NewMemoryStore()
+	}
+
+	congestion := congestionParams{minRTO: config.MinRTO, maxRTO: config.MaxRTO}.withDefaults()
+
+	return &Listener{
+		conn:        conn,
+		backend:     backend,
+		congestion:  congestion,
+		maxFileSize: config.MaxFileSize,
+		transfers:   map[string]*transfer{},
+	}, nil
+}
+
+// Serve reads inbound datagrams and dispatches them until the listener
+// socket errors out.
+func (self *Listener) Serve() {
+	buffer := make([]byte, 1024)
+
+	for {
+		bytesRead, addr, err := self.conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			panic(err)
+		}
+
+		self.dispatch(buffer[:bytesRead], addr)
+	}
+}
+
+func (self *Listener) dispatch(packet []byte, addr *net.UDPAddr) {
+	self.mutex.Lock()
+	_, inProgress := self.transfers[addr.String()]
+	self.mutex.Unlock()
+
+	if inProgress {
+		return
+	}
+
+	request := parseRequest(packet)
+
+	if request.opcode != ReadRequestOp && request.opcode != WriteRequestOp {
+		self.conn.WriteToUDP(errorPacket(IllegalOperationError, ""), addr)
+		return
+	}
+
+	transferConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+
+	if err != nil {
+		self.conn.WriteToUDP(errorPacket(NotDefinedError, "Failed to allocate a transfer socket"), addr)
+		return
+	}
+
+	self.mutex.Lock()
+	self.transfers[addr.String()] = &transfer{
+		remoteAddr: addr,
+		localPort:  transferConn.LocalAddr().(*net.UDPAddr).Port,
+	}
+	self.mutex.Unlock()
+
+	conn := &verifiedUDPConn{conn: transferConn, remoteAddr: addr}
+
+	go func() {
+		defer self.untrack(addr)
+
+		switch request.opcode {
+		case ReadRequestOp:
+			handleReadRequest(request, conn, self.backend, self.congestion)
+		case WriteRequestOp:
+			handleWriteRequest(request, conn, self.backend, self.maxFileSize)
+		}
+	}()
+}
+
+func (self *Listener) untrack(addr *net.UDPAddr) {
+	self.mutex.Lock()
+	delete(self.transfers, addr.String())
+	self.mutex.Unlock()
+}
+
+// verifiedUDPConn wraps an unconnected UDP socket bound to an ephemeral
+// port (the server's half of a transfer ID) and enforces RFC 1350's
+// transfer-ID rule: only datagrams from remoteAddr are handed back to the
+// caller. A datagram from anyone else is a stray packet from an unrelated
+// sender; it gets an UnknownTransferIdError reply and is otherwise
+// ignored, leaving the real transfer undisturbed.
+type verifiedUDPConn struct {
+	conn       *net.UDPConn
+	remoteAddr *net.UDPAddr
+}
+
+func (self *verifiedUDPConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := self.conn.ReadFromUDP(b)
+
+		if err != nil {
+			return n, err
+		}
+
+		if addr.IP.Equal(self.remoteAddr.IP) && addr.Port == self.remoteAddr.Port {
+			return n, nil
+		}
+
+		self.conn.WriteToUDP(errorPacket(UnknownTransferIdError, "Unknown transfer ID"), addr)
+	}
+}
+
+func (self *verifiedUDPConn) Write(b []byte) (int, error) {
+	return self.conn.WriteToUDP(b, self.remoteAddr)
+}
+
+func (self *verifiedUDPConn) Close() error {
+	return self.conn.Close()
+}
+
+func (self *verifiedUDPConn) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *verifiedUDPConn) RemoteAddr() net.Addr {
+	return self.remoteAddr
+}
+
+func (self *verifiedUDPConn) SetDeadline(t time.Time) error {
+	return self.conn.SetDeadline(t)
+}
+
+func (self *verifiedUDPConn) SetReadDeadline(t time.Time) error {
+	return self.conn.SetReadDeadline(t)
+}
+
+func (self *verifiedUDPConn) SetWriteDeadline(t time.Time) error {
+	return self.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func udpLocalConn(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatalf("Failed to open a local UDP socket: %v", err)
+	}
+
+	return conn
+}
+
+func Test_verifiedUDPConn_strayPacketGetsUnknownTransferId(t *testing.T) {
+	transferConn := udpLocalConn(t)
+	defer transferConn.Close()
+
+	client := udpLocalConn(t)
+	defer client.Close()
+
+	stray := udpLocalConn(t)
+	defer stray.Close()
+
+	conn := &verifiedUDPConn{
+		conn:       transferConn,
+		remoteAddr: client.LocalAddr().(*net.UDPAddr),
+	}
+
+	if _, err := stray.WriteToUDP([]byte("not for you"), transferConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("Failed to send stray packet: %v", err)
+	}
+
+	expected := ackPacket(1)
+
+	if _, err := client.WriteToUDP(expected, transferConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("Failed to send real packet: %v", err)
+	}
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	bytesRead, err := conn.Read(buffer)
+
+	if err != nil {
+		t.Fatalf("Failed to read the real packet: %v", err)
+	}
+
+	if string(buffer[:bytesRead]) != string(expected) {
+		t.Errorf("Read the wrong packet: %#v, expected %#v", buffer[:bytesRead], expected)
+	}
+
+	stray.SetReadDeadline(time.Now().Add(time.Second))
+	bytesRead, _, err = stray.ReadFromUDP(buffer)
+
+	if err != nil {
+		t.Fatalf("Stray sender never got a reply: %v", err)
+	}
+
+	code, _ := parseErrorPacket(buffer[:bytesRead])
+
+	if code != UnknownTransferIdError {
+		t.Errorf("Expected stray sender to get UnknownTransferIdError, got %v", code)
+	}
+}
+
+func Test_Listener_ignoresRequestFromClientAlreadyInProgress(t *testing.T) {
+	// dispatch()'s de-duplication logic doesn't depend on the well-known
+	// port, so exercise it directly against a Listener built around a
+	// throwaway socket rather than binding :69.
+	conn := udpLocalConn(t)
+	defer conn.Close()
+
+	l := &Listener{
+		conn:      conn,
+		backend:   nil,
+		transfers: map[string]*transfer{},
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	l.transfers[addr.String()] = &transfer{remoteAddr: addr, localPort: 54321}
+
+	before := len(l.transfers)
+	l.dispatch(makeRequestPacket(ReadRequestOp, "file1", "octet"), addr)
+
+	if len(l.transfers) != before {
+		t.Error("Dispatching a request from an in-progress client should not change the transfer table")
+	}
+}
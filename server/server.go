@@ -4,14 +4,37 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"tftp/filestore"
 	"time"
 )
 
-const BlockSize = 512
-const Timeout = time.Second * 5
+const (
+	BlockSize    = 512
+	MinBlockSize = 8
+	MaxBlockSize = 65464
+)
+
+const (
+	Timeout           = time.Second * 5
+	MinTimeoutSeconds = 1
+	MaxTimeoutSeconds = 255
+)
+
+const (
+	DefaultWindowSize = 1
+	MaxWindowSize     = 65535
+)
+
+const (
+	DefaultMinRTO = 50 * time.Millisecond
+	DefaultMaxRTO = 60 * time.Second
+)
 
 type ErrorCode int
 
@@ -29,23 +52,84 @@ const (
 type OpCode uint16
 
 const (
-	ReadRequestOp  = OpCode(1)
-	WriteRequestOp = OpCode(2)
-	DataOp         = OpCode(3)
-	AckOp          = OpCode(4)
-	ErrorOp        = OpCode(5)
+	ReadRequestOp      = OpCode(1)
+	WriteRequestOp     = OpCode(2)
+	DataOp             = OpCode(3)
+	AckOp              = OpCode(4)
+	ErrorOp            = OpCode(5)
+	OackOp             = OpCode(6)
+	BlockListRequestOp = OpCode(7)
+	BlockListReplyOp   = OpCode(8)
+)
+
+const (
+	MinBlockListBlockSize = 1024
+	MaxBlockListBlockSize = 16 * 1024 * 1024
 )
 
 type requestPacket struct {
 	opcode   OpCode
 	filename string
 	mode     string
+	options  map[string]string
+}
+
+// transferOptions holds the per-connection values negotiated from a
+// request's options, replacing the package-level BlockSize/Timeout
+// constants for the lifetime of a single transfer.
+type transferOptions struct {
+	blockSize      int
+	timeout        time.Duration
+	windowSize     int
+	tsizeRequested bool
+
+	// blockListBlockSize, when non-zero, enables the block-level
+	// resume/delta extension and gives the chunk size to hash the file
+	// with.
+	blockListBlockSize int
+}
+
+// congestionParams bounds the adaptive retransmit timeout used by
+// handleReadRequest's congestion-controlled sender. Zero values are
+// replaced with DefaultMinRTO/DefaultMaxRTO.
+type congestionParams struct {
+	minRTO time.Duration
+	maxRTO time.Duration
+}
+
+func (self congestionParams) withDefaults() congestionParams {
+	if self.minRTO <= 0 {
+		self.minRTO = DefaultMinRTO
+	}
+
+	if self.maxRTO <= 0 {
+		self.maxRTO = DefaultMaxRTO
+	}
+
+	return self
 }
 
 func getOpCode(packet []byte) OpCode {
 	return OpCode(binary.BigEndian.Uint16(packet[:2]))
 }
 
+// splitNulTerminated splits data on NUL bytes, dropping the terminators
+// themselves. A final, unterminated field is discarded, since option/value
+// pairs are always NUL terminated on the wire.
+func splitNulTerminated(data []byte) []string {
+	fields := []string{}
+	start := 0
+
+	for i, b := range data {
+		if b == 0 {
+			fields = append(fields, string(data[start:i]))
+			start = i + 1
+		}
+	}
+
+	return fields
+}
+
 func parseRequest(packet []byte) requestPacket {
 	opcode := getOpCode(packet)
 	filename := ""
@@ -60,30 +144,101 @@ func parseRequest(packet []byte) requestPacket {
 		}
 	}
 
-	mode := string(packet[index+1:])
-
 	_, cleanFile := filepath.Split(filename)
 
+	modeStart := index + 1
+	modeEnd := len(packet)
+
+	for i := modeStart; i < len(packet); i++ {
+		if packet[i] == 0 {
+			modeEnd = i
+			break
+		}
+	}
+
+	mode := string(packet[modeStart:modeEnd])
+
+	options := map[string]string{}
+
+	if modeEnd < len(packet) {
+		fields := splitNulTerminated(packet[modeEnd+1:])
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			options[strings.ToLower(fields[i])] = fields[i+1]
+		}
+	}
+
 	return requestPacket{
 		opcode:   opcode,
 		filename: cleanFile,
 		mode:     mode,
+		options:  options,
 	}
 }
 
-func parseAck(packet []byte, expectedBlockNumber uint16) bool {
+// parseTransferOptions resolves the options requested on a transfer against
+// the server's supported ranges, returning the settings to use for the
+// transfer and the subset of options to echo back in an OACK. Unsupported
+// or out-of-range options are silently left out of the ack, per RFC 2347.
+func parseTransferOptions(requested map[string]string) (transferOptions, map[string]string) {
+	opts := transferOptions{
+		blockSize:  BlockSize,
+		timeout:    Timeout,
+		windowSize: DefaultWindowSize,
+	}
+
+	ack := map[string]string{}
+
+	if value, ok := requested["blksize"]; ok {
+		if size, err := strconv.Atoi(value); err == nil && size >= MinBlockSize && size <= MaxBlockSize {
+			opts.blockSize = size
+			ack["blksize"] = value
+		}
+	}
+
+	if value, ok := requested["timeout"]; ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= MinTimeoutSeconds && seconds <= MaxTimeoutSeconds {
+			opts.timeout = time.Duration(seconds) * time.Second
+			ack["timeout"] = value
+		}
+	}
+
+	if value, ok := requested["windowsize"]; ok {
+		if size, err := strconv.Atoi(value); err == nil && size >= 1 && size <= MaxWindowSize {
+			opts.windowSize = size
+			ack["windowsize"] = value
+		}
+	}
+
+	if _, ok := requested["tsize"]; ok {
+		opts.tsizeRequested = true
+	}
+
+	if value, ok := requested["blocklist"]; ok {
+		if size, err := strconv.Atoi(value); err == nil && size >= MinBlockListBlockSize && size <= MaxBlockListBlockSize {
+			opts.blockListBlockSize = size
+			ack["blocklist"] = value
+		}
+	}
+
+	return opts, ack
+}
+
+func parseAckBlockNumber(packet []byte) (uint16, bool) {
 	if len(packet) != 4 {
-		return false
+		return 0, false
 	}
 
-	opcode := getOpCode(packet)
-	if opcode != AckOp {
-		return false
+	if getOpCode(packet) != AckOp {
+		return 0, false
 	}
 
-	blockNumber := binary.BigEndian.Uint16(packet[2:4])
+	return binary.BigEndian.Uint16(packet[2:4]), true
+}
 
-	return blockNumber == expectedBlockNumber
+func parseAck(packet []byte, expectedBlockNumber uint16) bool {
+	blockNumber, ok := parseAckBlockNumber(packet)
+	return ok && blockNumber == expectedBlockNumber
 }
 
 func parseData(packet []byte) ([]byte, uint16, error) {
@@ -131,92 +286,331 @@ func errorPacket(code ErrorCode, message string) []byte {
 	return packet
 }
 
-func handleReadRequest(filename string, conn net.Conn) {
+// oackPacket builds an OACK (option acknowledgement) packet listing the
+// given options in a stable, sorted order.
+func oackPacket(options map[string]string) []byte {
+	packet := make([]byte, 2)
+	binary.BigEndian.PutUint16(packet, uint16(OackOp))
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		packet = append(packet, []byte(name)...)
+		packet = append(packet, 0)
+		packet = append(packet, []byte(options[name])...)
+		packet = append(packet, 0)
+	}
+
+	return packet
+}
+
+// exchangeOack sends an OACK and waits for the client's ACK of block 0,
+// retrying on timeout just like the per-block exchanges below.
+func exchangeOack(conn net.Conn, options map[string]string, timeout time.Duration, buffer []byte) bool {
+	packet := oackPacket(options)
+	attempts := 1
+
+	for {
+		if attempts > 5 {
+			return false
+		}
+
+		conn.Write(packet)
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		bytesRead, err := conn.Read(buffer)
+
+		if err == nil && parseAck(buffer[:bytesRead], 0) {
+			return true
+		}
+
+		attempts++
+	}
+}
+
+// readBlock reads one block worth of bytes from reader, returning the data
+// read and whether this was the final block of the file. A block shorter
+// than blockSize (possibly empty) always marks the end, matching the wire
+// convention that a full block is followed by at least one more.
+func readBlock(reader io.Reader, blockSize int) ([]byte, bool, error) {
+	buffer := make([]byte, blockSize)
+	n, err := io.ReadFull(reader, buffer)
+
+	switch err {
+	case nil:
+		return buffer, false, nil
+	case io.ErrUnexpectedEOF, io.EOF:
+		return buffer[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// inFlightBlock records when a sent block was last transmitted, so an RTT
+// sample can be taken once it's acked.
+type inFlightBlock struct {
+	sent   bool
+	sentAt time.Time
+}
+
+// updateRTO folds a new RTT sample into srtt/rttvar using the Jacobson/Karels
+// algorithm and derives the resulting retransmit timeout, clamped to
+// congestion's bounds.
+func updateRTO(srtt, rttvar, sample time.Duration, congestion congestionParams) (time.Duration, time.Duration, time.Duration) {
+	if srtt == 0 && rttvar == 0 {
+		srtt = sample
+		rttvar = sample / 2
+	} else {
+		diff := sample - srtt
+		if diff < 0 {
+			diff = -diff
+		}
+
+		rttvar = rttvar*3/4 + diff/4
+		srtt = srtt*7/8 + sample/8
+	}
+
+	rto := srtt + 4*rttvar
+
+	if rto < congestion.minRTO {
+		rto = congestion.minRTO
+	} else if rto > congestion.maxRTO {
+		rto = congestion.maxRTO
+	}
+
+	return srtt, rttvar, rto
+}
+
+// abortWrite discards an in-progress write without making it visible.
+// Backends whose writer doesn't persist anything until Close (MemoryStore)
+// need no action; DiskStore's writer implements Abort to remove its temp
+// file instead of leaving a stranded partial on disk.
+func abortWrite(writer io.WriteCloser) {
+	if aborter, ok := writer.(interface{ Abort() }); ok {
+		aborter.Abort()
+	}
+}
+
+// halveCwnd halves a congestion window, with a floor of 1.
+func halveCwnd(cwnd int) int {
+	cwnd /= 2
+
+	if cwnd < 1 {
+		return 1
+	}
+
+	return cwnd
+}
+
+func handleReadRequest(request requestPacket, conn net.Conn, backend filestore.Backend, congestion congestionParams) {
 	defer conn.Close()
 
-	file, found := filestore.Get(filename)
+	reader, size, err := backend.OpenRead(request.filename)
 
-	if !found {
-		conn.Write(errorPacket(FileNotFoundError, fmt.Sprintf("File not found: %s", filename)))
+	if err != nil {
+		conn.Write(errorPacket(FileNotFoundError, fmt.Sprintf("File not found: %s", request.filename)))
 		return
 	}
+	defer reader.Close()
 
-	blockNumber := uint16(1)
-	done := false
+	opts, ack := parseTransferOptions(request.options)
+
+	if opts.tsizeRequested {
+		ack["tsize"] = fmt.Sprintf("%d", size)
+	}
 
 	buffer := make([]byte, 1024)
 
-	for {
-		index := int(BlockSize * (blockNumber - 1))
+	if len(ack) > 0 {
+		if !exchangeOack(conn, ack, opts.timeout, buffer) {
+			conn.Write(errorPacket(NotDefinedError, "Failed to get ACK for OACK after 5 attempts"))
+			return
+		}
+	}
+
+	if opts.blockListBlockSize > 0 {
+		handleBlockListResumeRead(request, conn, backend, opts)
+		return
+	}
 
-		length := BlockSize
+	congestion = congestion.withDefaults()
 
-		if len(file)-index < BlockSize {
-			length = len(file) - int(index)
-			done = true
+	lastAcked := uint16(0)
+	finalBlock := uint16(0)
+	done := false
+
+	cwnd := 1
+	srtt := time.Duration(0)
+	rttvar := time.Duration(0)
+	rto := opts.timeout
+
+	// inFlight is a ring buffer of the blocks currently awaiting an ACK,
+	// keyed by blockNumber modulo its length, so a cumulative ACK for
+	// block N can look up when N was sent to take an RTT sample.
+	inFlight := make([]inFlightBlock, opts.windowSize)
+
+	for !done {
+		window := cwnd
+		if window > opts.windowSize {
+			window = opts.windowSize
+		}
+
+		packets := [][]byte{}
+
+		for block := lastAcked + 1; block <= lastAcked+uint16(window); block++ {
+			data, isLast, err := readBlock(reader, opts.blockSize)
+
+			if err != nil {
+				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to read block %v: %v", block, err)))
+				return
+			}
+
+			packets = append(packets, dataPacket(data, block))
+
+			if isLast {
+				finalBlock = block
+				break
+			}
 		}
 
 		attempts := 1
-		packetToSend := dataPacket(file[index:index+length], blockNumber)
+		acked := false
 
-		for {
+		for !acked {
 			if attempts >= 5 {
-				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to get ACK for data block %v after 5 attempts", blockNumber)))
+				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to get ACK for data block %v after 5 attempts", lastAcked+1)))
 				return
 			}
 
-			conn.Write(packetToSend)
+			sentAt := time.Now()
+
+			for i, packet := range packets {
+				block := lastAcked + 1 + uint16(i)
+				inFlight[int(block)%len(inFlight)] = inFlightBlock{sent: true, sentAt: sentAt}
+				conn.Write(packet)
+			}
 
-			conn.SetReadDeadline(time.Now().Add(Timeout))
+			conn.SetReadDeadline(time.Now().Add(rto))
 			bytesRead, err := conn.Read(buffer)
 
-			if err == nil && parseAck(buffer[:bytesRead], blockNumber) {
-				break // Success
+			if err == nil {
+				if ackedBlock, ok := parseAckBlockNumber(buffer[:bytesRead]); ok && ackedBlock > lastAcked && ackedBlock <= lastAcked+uint16(len(packets)) {
+					if attempts == 1 {
+						// Karn's algorithm: only sample RTT from blocks that
+						// weren't retransmitted, to avoid conflating an ACK
+						// for the original send with one for a retransmit.
+						if entry := inFlight[int(ackedBlock)%len(inFlight)]; entry.sent {
+							srtt, rttvar, rto = updateRTO(srtt, rttvar, time.Since(entry.sentAt), congestion)
+						}
+					}
+
+					if ackedBlock == lastAcked+uint16(len(packets)) {
+						cwnd++
+					}
+
+					lastAcked = ackedBlock
+					acked = true
+
+					if finalBlock != 0 && lastAcked == finalBlock {
+						done = true
+					}
+
+					continue
+				}
 			}
 
-			// Timed out waiting for ACK, couldn't parse ACK packet, or wrong block number
+			// Timed out, couldn't parse the ACK, or it was out of order:
+			// treat it as a sign of congestion, then rewind and resend the
+			// whole window starting at lastAcked+1.
+			cwnd = halveCwnd(cwnd)
 			attempts++
 		}
+	}
 
-		blockNumber++
+	fmt.Println(fmt.Sprintf("Successfully sent file: %s", request.filename))
+}
 
-		if done {
-			fmt.Println(fmt.Sprintf("Successfully sent file: %s", filename))
-			break
+func handleWriteRequest(request requestPacket, conn net.Conn, backend filestore.Backend, maxFileSize int64) {
+	defer conn.Close()
+
+	opts, ack := parseTransferOptions(request.options)
+
+	// A block-list resume is expected to target a file the server already
+	// has a copy of, so it gets to bypass the usual already-exists guard.
+	if opts.blockListBlockSize == 0 && backend.Exists(request.filename) {
+		conn.Write(errorPacket(FileAlreadyExistsError, fmt.Sprintf("File already exists: %s", request.filename)))
+		return
+	}
+
+	if value, ok := request.options["tsize"]; ok {
+		if declaredSize, err := strconv.ParseInt(value, 10, 64); err == nil {
+			if maxFileSize > 0 && declaredSize > maxFileSize {
+				conn.Write(errorPacket(DiskFullError, fmt.Sprintf("Declared file size %v exceeds the server limit of %v bytes", declaredSize, maxFileSize)))
+				return
+			}
+
+			ack["tsize"] = value
 		}
 	}
-}
 
-func handleWriteRequest(filename string, conn net.Conn) {
-	defer conn.Close()
+	if opts.blockListBlockSize > 0 {
+		handleBlockListResumeWrite(request, conn, backend, opts, ack, maxFileSize)
+		return
+	}
+
+	writer, err := backend.OpenWrite(request.filename)
 
-	if filestore.Exists(filename) {
-		conn.Write(errorPacket(FileAlreadyExistsError, fmt.Sprintf("File already exists: %s", filename)))
+	if err != nil {
+		conn.Write(errorPacket(FileAlreadyExistsError, fmt.Sprintf("File already exists: %s", request.filename)))
 		return
 	}
 
-	file := []byte{}
+	totalBytes := 0
 	blockNumber := uint16(0)
+	buffer := make([]byte, opts.blockSize+4)
+
+	ackToSend := ackPacket(0)
+	if len(ack) > 0 {
+		ackToSend = oackPacket(ack)
+	}
 
 	for {
-		buffer := make([]byte, 1024)
 		attempts := 1
-
-		var packet []byte
+		received := [][]byte{}
 
 		for {
 			if attempts >= 5 {
-				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to get data block #%v after 5 attempts", blockNumber)))
+				conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Failed to get data block #%v after 5 attempts", blockNumber+1)))
+				abortWrite(writer)
 				return
 			}
 
-			conn.Write(ackPacket(blockNumber))
-			conn.SetReadDeadline(time.Now().Add(Timeout))
+			conn.Write(ackToSend)
+			conn.SetReadDeadline(time.Now().Add(opts.timeout))
 
-			bytesRead, err := conn.Read(buffer)
+			received = received[:0]
 
-			if err == nil {
-				packet = buffer[:bytesRead]
+			for i := 0; i < opts.windowSize; i++ {
+				bytesRead, err := conn.Read(buffer)
+
+				if err != nil {
+					break
+				}
+
+				packet := make([]byte, bytesRead)
+				copy(packet, buffer[:bytesRead])
+				received = append(received, packet)
+
+				if bytesRead < opts.blockSize+4 {
+					break // A short block marks the end of the window.
+				}
+			}
+
+			if len(received) > 0 {
 				break
 			}
 
@@ -224,29 +618,40 @@ func handleWriteRequest(filename string, conn net.Conn) {
 			attempts++
 		}
 
-		blockNumber++
-		data, block, err := parseData(packet)
+		lastGood := blockNumber
+		finished := false
 
-		if err != nil {
-			conn.Write(errorPacket(NotDefinedError, "Unable to parse data packet"))
-			return
-		}
+		for _, packet := range received {
+			data, block, err := parseData(packet)
 
-		if block != blockNumber {
-			conn.Write(errorPacket(NotDefinedError, fmt.Sprintf("Expected block #%v, but got #%v instead", blockNumber, block)))
-			return
-		}
+			if err != nil || block != lastGood+1 {
+				break // Gap or corrupt packet: stop at the last good block.
+			}
+
+			if _, err := writer.Write(data); err != nil {
+				abortWrite(writer)
+				conn.Write(errorPacket(NotDefinedError, "Failed to write data to storage"))
+				return
+			}
+
+			totalBytes += len(data)
+			lastGood++
 
-		file = append(file, data...)
+			if len(packet) < opts.blockSize+4 {
+				finished = true
+				break
+			}
+		}
 
-		if len(packet) < (4 + BlockSize) {
-			success := filestore.Create(filename, file)
+		blockNumber = lastGood
+		ackToSend = ackPacket(blockNumber)
 
-			if success {
-				conn.Write(ackPacket(blockNumber))
-				fmt.Println(fmt.Sprintf("Successfully wrote file: %s, %v bytes", filename, len(file)))
+		if finished {
+			if err := writer.Close(); err != nil {
+				conn.Write(errorPacket(FileAlreadyExistsError, fmt.Sprintf("File already exists: %s", request.filename)))
 			} else {
-				conn.Write(errorPacket(FileAlreadyExistsError, fmt.Sprintf("File already exists: %s", filename)))
+				conn.Write(ackPacket(blockNumber))
+				fmt.Println(fmt.Sprintf("Successfully wrote file: %s, %v bytes", request.filename, totalBytes))
 			}
 
 			return
@@ -254,38 +659,28 @@ func handleWriteRequest(filename string, conn net.Conn) {
 	}
 }
 
-func Run() {
-	filestore.Init()
+// Config selects the storage backend and tunes the congestion-controlled
+// retransmit timeout used by Run. MinRTO and MaxRTO are both optional; zero
+// falls back to DefaultMinRTO/DefaultMaxRTO.
+type Config struct {
+	Backend filestore.Backend
+	MinRTO  time.Duration
+	MaxRTO  time.Duration
+
+	// MaxFileSize, when non-zero, caps the file size a client may declare
+	// via the tsize option on a write request. Writes that would exceed it
+	// are rejected with DiskFullError before any data is transferred.
+	MaxFileSize int64
+}
 
-	laddr, _ := net.ResolveUDPAddr("udp", ":69")
-	conn, err := net.ListenUDP("udp", laddr)
+// Run starts a Listener on the well-known TFTP port and serves requests
+// until it's killed or the socket errors out.
+func Run(config Config) {
+	listener, err := NewListener(config)
 
 	if err != nil {
 		panic(err)
 	}
 
-	for {
-		buffer := make([]byte, 1024)
-		bytesRead, addr, err := conn.ReadFrom(buffer)
-
-		if err != nil {
-			panic(err)
-		}
-
-		request := parseRequest(buffer[:bytesRead])
-
-		raddr, _ := net.ResolveUDPAddr("udp", addr.String())
-		laddr, _ := net.ResolveUDPAddr("udp", ":0")
-
-		conn, _ := net.DialUDP("udp", laddr, raddr)
-
-		switch request.opcode {
-		case ReadRequestOp:
-			go handleReadRequest(request.filename, conn)
-		case WriteRequestOp:
-			go handleWriteRequest(request.filename, conn)
-		default:
-			conn.Write(errorPacket(IllegalOperationError, ""))
-		}
-	}
+	listener.Serve()
 }
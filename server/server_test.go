@@ -24,6 +24,8 @@ type fakeConn struct {
 	t       *testing.T
 }
 
+// A nil entry in packets simulates a lost packet: Read reports a timeout
+// instead of handing back data, without failing the test.
 func (self *fakeConn) Read(b []byte) (int, error) {
 	if len(self.packets) == 0 {
 		self.t.Error("Got an unexpected read (no more packets)", b)
@@ -31,10 +33,14 @@ func (self *fakeConn) Read(b []byte) (int, error) {
 	}
 
 	packet := self.packets[0]
-	copy(b, packet)
-
 	self.packets = self.packets[1:]
 
+	if packet == nil {
+		return 0, errors.New("simulated timeout")
+	}
+
+	copy(b, packet)
+
 	return len(packet), nil
 }
 
@@ -176,6 +182,20 @@ func makeRequestPacket(op OpCode, filename, mode string) []byte {
 	return packet
 }
 
+func makeRequestPacketWithOptions(op OpCode, filename, mode string, options map[string]string) []byte {
+	packet := makeRequestPacket(op, filename, mode)
+	packet = append(packet, 0)
+
+	for name, value := range options {
+		packet = append(packet, []byte(name)...)
+		packet = append(packet, 0)
+		packet = append(packet, []byte(value)...)
+		packet = append(packet, 0)
+	}
+
+	return packet
+}
+
 func parseErrorPacket(packet []byte) (ErrorCode, string) {
 	code := ErrorCode(binary.BigEndian.Uint16(packet[2:4]))
 	message := packet[2 : len(packet)-1]
@@ -203,11 +223,95 @@ func Test_parseRequest(t *testing.T) {
 	}
 }
 
+func Test_parseRequest_options(t *testing.T) {
+	filename := "this_is_a_filename"
+	mode := "octet"
+	options := map[string]string{
+		"blksize":    "1024",
+		"timeout":    "3",
+		"tsize":      "0",
+		"windowsize": "4",
+	}
+
+	packet := makeRequestPacketWithOptions(ReadRequestOp, filename, mode, options)
+
+	parsed := parseRequest(packet)
+
+	if parsed.filename != filename {
+		t.Error("Failed to parse request packet filename")
+	}
+
+	if parsed.mode != mode {
+		t.Errorf("Failed to parse mode. Expected: '%#v', got: '%#v'", mode, parsed.mode)
+	}
+
+	for name, value := range options {
+		if parsed.options[name] != value {
+			t.Errorf("Failed to parse option %v. Expected: '%v', got: '%v'", name, value, parsed.options[name])
+		}
+	}
+}
+
+func Test_oackPacket(t *testing.T) {
+	packet := oackPacket(map[string]string{"blksize": "1024", "timeout": "3"})
+
+	opcode := OpCode(binary.BigEndian.Uint16(packet[:2]))
+	if opcode != OackOp {
+		t.Errorf("OACK packet created with incorrect opcode: %#v", opcode)
+	}
+
+	expected := "blksize\x001024\x00timeout\x003\x00"
+	if string(packet[2:]) != expected {
+		t.Errorf("OACK packet had incorrect body: %#v, expected %#v", string(packet[2:]), expected)
+	}
+}
+
+func Test_parseTransferOptions(t *testing.T) {
+	opts, ack := parseTransferOptions(map[string]string{
+		"blksize":    "1024",
+		"timeout":    "3",
+		"windowsize": "4",
+		"tsize":      "0",
+	})
+
+	if opts.blockSize != 1024 {
+		t.Errorf("Expected negotiated block size 1024, got %v", opts.blockSize)
+	}
+
+	if opts.timeout != 3*time.Second {
+		t.Errorf("Expected negotiated timeout of 3s, got %v", opts.timeout)
+	}
+
+	if opts.windowSize != 4 {
+		t.Errorf("Expected negotiated window size 4, got %v", opts.windowSize)
+	}
+
+	if !opts.tsizeRequested {
+		t.Error("Expected tsize to be marked as requested")
+	}
+
+	// tsize is acked by the caller once it knows the file length (reads) or
+	// has validated the declared size (writes), not by parseTransferOptions.
+	if len(ack) != 3 {
+		t.Errorf("Expected blksize, timeout and windowsize to be acked, got %v", ack)
+	}
+
+	opts, ack = parseTransferOptions(map[string]string{"blksize": "4"})
+
+	if opts.blockSize != BlockSize {
+		t.Errorf("Out-of-range blksize should have been ignored, got %v", opts.blockSize)
+	}
+
+	if len(ack) != 0 {
+		t.Errorf("Out-of-range blksize should not have been acked, got %v", ack)
+	}
+}
+
 func Test_handleWriteRequest(t *testing.T) {
 	var conn fakeConn
 	conn.t = t
 
-	filestore.Init()
+	backend := filestore.NewMemoryStore()
 
 	file := fakeData(500)
 	conn.packets = [][]byte{
@@ -215,7 +319,7 @@ func Test_handleWriteRequest(t *testing.T) {
 		dataPacket(file, 1),
 		ackPacket(1),
 	}
-	handleWriteRequest("file1", &conn)
+	handleWriteRequest(requestPacket{filename: "file1", options: map[string]string{}}, &conn, backend, 0)
 
 	if len(conn.packets) != 0 {
 		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
@@ -229,7 +333,7 @@ func Test_handleWriteRequest(t *testing.T) {
 		dataPacket([]byte{}, 2),
 		ackPacket(2),
 	}
-	handleWriteRequest("file2", &conn)
+	handleWriteRequest(requestPacket{filename: "file2", options: map[string]string{}}, &conn, backend, 0)
 
 	if len(conn.packets) != 0 {
 		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
@@ -245,34 +349,55 @@ func Test_handleWriteRequest(t *testing.T) {
 		dataPacket([]byte{}, 3),
 		ackPacket(3),
 	}
-	handleWriteRequest("file3", &conn)
+	handleWriteRequest(requestPacket{filename: "file3", options: map[string]string{}}, &conn, backend, 0)
 
 	if len(conn.packets) != 0 {
 		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
 	}
 }
 
+func Test_handleWriteRequest_tsizeExceedsMaxFileSize(t *testing.T) {
+	var conn fakeConn
+	conn.t = t
+
+	backend := filestore.NewMemoryStore()
+
+	conn.packets = [][]byte{
+		errorPacket(DiskFullError, "Declared file size 2000 exceeds the server limit of 1000 bytes"),
+	}
+
+	handleWriteRequest(requestPacket{filename: "file1", options: map[string]string{"tsize": "2000"}}, &conn, backend, 1000)
+
+	if len(conn.packets) != 0 {
+		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
+	}
+
+	if backend.Exists("file1") {
+		t.Error("File should not have been created when the declared size exceeds the limit")
+	}
+}
+
 func Test_handleReadRequest(t *testing.T) {
 	var conn fakeConn
 	conn.t = t
 
-	filestore.Init()
+	backend := filestore.NewMemoryStore()
 
 	expectedFile := fakeData(500)
-	filestore.Create("file1", expectedFile)
+	backend.Create("file1", expectedFile)
 
 	conn.packets = [][]byte{
 		dataPacket(expectedFile, 1),
 		ackPacket(1),
 	}
-	handleReadRequest("file1", &conn)
+	handleReadRequest(requestPacket{filename: "file1", options: map[string]string{}}, &conn, backend, congestionParams{})
 
 	if len(conn.packets) != 0 {
 		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
 	}
 
 	expectedFile = fakeData(512)
-	filestore.Create("file2", expectedFile)
+	backend.Create("file2", expectedFile)
 
 	conn.packets = [][]byte{
 		dataPacket(expectedFile, 1),
@@ -280,14 +405,14 @@ func Test_handleReadRequest(t *testing.T) {
 		dataPacket([]byte{}, 2),
 		ackPacket(2),
 	}
-	handleReadRequest("file2", &conn)
+	handleReadRequest(requestPacket{filename: "file2", options: map[string]string{}}, &conn, backend, congestionParams{})
 
 	if len(conn.packets) != 0 {
 		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
 	}
 
 	expectedFile = fakeData(1024)
-	filestore.Create("file3", expectedFile)
+	backend.Create("file3", expectedFile)
 
 	conn.packets = [][]byte{
 		dataPacket(expectedFile[:512], 1),
@@ -297,7 +422,53 @@ func Test_handleReadRequest(t *testing.T) {
 		dataPacket([]byte{}, 3),
 		ackPacket(3),
 	}
-	handleReadRequest("file3", &conn)
+	handleReadRequest(requestPacket{filename: "file3", options: map[string]string{}}, &conn, backend, congestionParams{})
+
+	if len(conn.packets) != 0 {
+		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))
+	}
+}
+
+func Test_handleReadRequest_congestionWindow(t *testing.T) {
+	var conn fakeConn
+	conn.t = t
+
+	backend := filestore.NewMemoryStore()
+
+	file := fakeData(36) // 4 full 8-byte blocks plus a final short one
+	backend.Create("file1", file)
+
+	conn.packets = [][]byte{
+		// The negotiated blksize/windowsize are acked via OACK first.
+		oackPacket(map[string]string{"blksize": "8", "windowsize": "4"}),
+		ackPacket(0),
+
+		// Round 1: cwnd=1, windowsize ceiling=4 -> window of 1. A full
+		// window ACK grows cwnd to 2.
+		dataPacket(file[0:8], 1),
+		ackPacket(1),
+
+		// Round 2: window of 2. The first attempt is lost, which should
+		// halve cwnd back to 1 before the retry.
+		dataPacket(file[8:16], 2),
+		dataPacket(file[16:24], 3),
+		nil,
+		dataPacket(file[8:16], 2),
+		dataPacket(file[16:24], 3),
+		ackPacket(3),
+
+		// Round 3: cwnd recovered to 2, window of 2, reaching the final
+		// (short) block.
+		dataPacket(file[24:32], 4),
+		dataPacket(file[32:36], 5),
+		ackPacket(5),
+	}
+
+	request := requestPacket{
+		filename: "file1",
+		options:  map[string]string{"blksize": "8", "windowsize": "4"},
+	}
+	handleReadRequest(request, &conn, backend, congestionParams{})
 
 	if len(conn.packets) != 0 {
 		t.Errorf("Did not complete transacion, %v packets still left", len(conn.packets))